@@ -0,0 +1,58 @@
+package engine
+
+import "sync"
+
+// Backend is the persistence abstraction NabiaDB dispatches reads, writes,
+// deletes and iteration to. Swapping the Backend lets callers trade off
+// durability, speed and on-disk format without touching the NabiaDB API.
+type Backend interface {
+	// Get returns the record stored under key, and whether it was found.
+	Get(key string) (*NabiaRecord, bool)
+	// Put stores (or overwrites) the record under key.
+	Put(key string, r *NabiaRecord) error
+	// Delete removes key. It is not an error to delete a key that doesn't exist.
+	Delete(key string) error
+	// Range calls fn for every stored key/record pair, in no particular
+	// order, stopping early if fn returns false.
+	Range(fn func(key string, r *NabiaRecord) bool)
+	// Close releases any resources (file handles, DB handles) held by the
+	// backend. NabiaDB calls this from Stop.
+	Close() error
+}
+
+// BackendFactory builds a Backend rooted at location. location is
+// interpreted however the backend sees fit: a file path, a directory, etc.
+type BackendFactory func(location string) (Backend, error)
+
+var (
+	backendRegistryMu sync.RWMutex
+	backendRegistry   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a Backend implementation available under name, for
+// use with WithBackend. This mirrors the driver-registration pattern used
+// throughout the Go ecosystem (e.g. database/sql drivers): third parties can
+// register their own backend without NabiaDB needing to know about it ahead
+// of time. RegisterBackend is typically called from an init function and
+// panics if name is already registered.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendRegistryMu.Lock()
+	defer backendRegistryMu.Unlock()
+	if _, exists := backendRegistry[name]; exists {
+		panic("engine: RegisterBackend called twice for backend " + name)
+	}
+	backendRegistry[name] = factory
+}
+
+func lookupBackend(name string) (BackendFactory, bool) {
+	backendRegistryMu.RLock()
+	defer backendRegistryMu.RUnlock()
+	factory, ok := backendRegistry[name]
+	return factory, ok
+}
+
+func init() {
+	RegisterBackend("file", newFileBackend)
+	RegisterBackend("memory", newMemoryBackend)
+	RegisterBackend("bbolt", newBoltBackend)
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"go.etcd.io/bbolt"
+)
+
+// nabiaBucket is the single bbolt bucket every record is stored in, keyed by
+// path.
+var nabiaBucket = []byte("nabia")
+
+// errStopRange is an internal sentinel used to unwind out of a bbolt
+// ForEach when the caller's Range callback asks us to stop early.
+var errStopRange = errors.New("engine: stop range")
+
+// boltBackend stores each record as a gob-encoded value in a bbolt bucket
+// keyed by path. Every write is its own bbolt transaction and is fsynced on
+// commit; unlike fileBackend, whose WAL fsyncs according to its SyncPolicy,
+// this cannot be relaxed with WithSyncPolicy.
+type boltBackend struct {
+	db *bbolt.DB
+}
+
+func newBoltBackend(location string) (Backend, error) {
+	db, err := bbolt.Open(location, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(nabiaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltBackend{db: db}, nil
+}
+
+func (b *boltBackend) Get(key string) (*NabiaRecord, bool) {
+	var record *NabiaRecord
+	err := b.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(nabiaBucket).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		var r NabiaRecord
+		if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&r); err != nil {
+			return err
+		}
+		record = &r
+		return nil
+	})
+	if err != nil || record == nil {
+		return nil, false
+	}
+	return record, true
+}
+
+func (b *boltBackend) Put(key string, r *NabiaRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(r); err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(nabiaBucket).Put([]byte(key), buf.Bytes())
+	})
+}
+
+func (b *boltBackend) Delete(key string) error {
+	return b.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(nabiaBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltBackend) Range(fn func(key string, r *NabiaRecord) bool) {
+	b.db.View(func(tx *bbolt.Tx) error {
+		err := tx.Bucket(nabiaBucket).ForEach(func(k, v []byte) error {
+			var r NabiaRecord
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&r); err != nil {
+				return err
+			}
+			if !fn(string(k), &r) {
+				return errStopRange
+			}
+			return nil
+		})
+		if err == errStopRange {
+			return nil
+		}
+		return err
+	})
+}
+
+func (b *boltBackend) Close() error {
+	return b.db.Close()
+}
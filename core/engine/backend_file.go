@@ -0,0 +1,260 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// fileBackend is the original Nabia persistence strategy: records live in a
+// sync.Map, snapshotted to a file, with a write-ahead log (see wal.go)
+// guarding the writes that happen between snapshots. Without the WAL a
+// crash between snapshots would lose everything written since the last
+// save; with it, only writes that never made it past fsync are at risk, per
+// the configured SyncPolicy.
+//
+// The snapshot itself can be written in one of two formats: legacy (the
+// whole map gob-encoded in one shot) or v2 (see format.go), selected by
+// formatVersion. loadFromFile sniffs the file's magic bytes and reads
+// whichever format is actually on disk, so existing legacy databases keep
+// opening regardless of what new databases are being written as.
+type fileBackend struct {
+	records       sync.Map
+	location      string
+	wal           *wal
+	formatVersion int
+}
+
+// checkOrCreateFile checks if the file exists, and if it doesn't, it creates it.
+// The boolean indicates whether the file already existed, and the error is
+// non-nil if checking for or creating the file failed.
+func checkOrCreateFile(location string) (bool, error) {
+	// Stat the file to check if it exists.
+	if _, err := os.Stat(location); err == nil {
+		// The file exists.
+		return true, nil
+	} else if os.IsNotExist(err) {
+		// The file does not exist, attempt to create it.
+		file, err := os.Create(location)
+		if err != nil {
+			// Failed to create the file, return the error.
+			return false, err
+		}
+		// Successfully created the file, close it.
+		defer file.Close()
+		return false, nil
+	} else {
+		// Some other error occurred when checking the file, return it.
+		return false, err
+	}
+}
+
+// walLocation returns the path of the WAL that guards location.
+func walLocation(location string) string {
+	return location + ".wal"
+}
+
+func newFileBackend(location string) (Backend, error) {
+	exists, err := checkOrCreateFile(location)
+	if err != nil {
+		return nil, err
+	}
+	b := &fileBackend{location: location, formatVersion: 1}
+	if exists {
+		if err := b.loadFromFile(location); err != nil {
+			return nil, err
+		}
+	} else {
+		if err := b.saveToFile(location); err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := openWAL(walLocation(location), SyncAlways())
+	if err != nil {
+		return nil, err
+	}
+	b.wal = w
+
+	// Replay any writes that landed in the WAL after the last snapshot.
+	if err := walReplay(walLocation(location),
+		func(key string, r *NabiaRecord) { b.records.Store(key, r) },
+		func(key string) { b.records.Delete(key) },
+	); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *fileBackend) Get(key string) (*NabiaRecord, bool) {
+	value, ok := b.records.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*NabiaRecord), true
+}
+
+func (b *fileBackend) Put(key string, r *NabiaRecord) error {
+	if err := b.wal.appendPut(key, r); err != nil {
+		return err
+	}
+	b.records.Store(key, r)
+	return nil
+}
+
+func (b *fileBackend) Delete(key string) error {
+	if err := b.wal.appendDelete(key); err != nil {
+		return err
+	}
+	b.records.Delete(key)
+	return nil
+}
+
+func (b *fileBackend) Range(fn func(key string, r *NabiaRecord) bool) {
+	b.records.Range(func(key, value interface{}) bool {
+		return fn(key.(string), value.(*NabiaRecord))
+	})
+}
+
+// Close writes a final snapshot and closes the WAL. It truncates the WAL
+// first, the same way Checkpoint does, once that snapshot is safely on
+// disk: without this, the stale WAL entries would get replayed on top of
+// the very snapshot that already includes them the next time the database
+// is opened, growing the WAL forever and re-applying already-captured
+// writes on every restart.
+func (b *fileBackend) Close() error {
+	if err := b.saveToFile(b.location); err != nil {
+		b.wal.close()
+		return err
+	}
+	if err := b.wal.truncate(); err != nil {
+		b.wal.close()
+		return err
+	}
+	return b.wal.close()
+}
+
+// ApplyBatch applies a set of puts and deletes as a single WAL batch,
+// fsyncing once for the whole set instead of once per mutation. It
+// implements the batchApplier capability interface used by Tx.Commit.
+func (b *fileBackend) ApplyBatch(puts map[string]*NabiaRecord, deletes map[string]struct{}) error {
+	if err := b.wal.appendBatch(puts, deletes); err != nil {
+		return err
+	}
+	for key, record := range puts {
+		b.records.Store(key, record)
+	}
+	for key := range deletes {
+		b.records.Delete(key)
+	}
+	return nil
+}
+
+// SetSyncPolicy changes how aggressively the WAL fsyncs. It implements the
+// syncPolicySetter capability interface NewNabiaDB looks for when the
+// WithSyncPolicy option is used.
+func (b *fileBackend) SetSyncPolicy(policy SyncPolicy) {
+	b.wal.setPolicy(policy)
+}
+
+// Checkpoint atomically rewrites the snapshot file from the current
+// in-memory state via a temp-file-plus-rename, then truncates the WAL,
+// since every record it described is now captured in the new snapshot.
+// It implements the Checkpointer capability interface.
+func (b *fileBackend) Checkpoint() error {
+	tmp := b.location + ".checkpoint.tmp"
+	if err := b.saveToFile(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, b.location); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return b.wal.truncate()
+}
+
+// SetFormatVersion selects the on-disk snapshot format saveToFile writes:
+// 1 (the default) for the legacy whole-map gob encoding, 2 for the
+// streamable, per-record-framed, CRC-checked format v2. It implements the
+// formatVersionSetter capability interface used by WithFormatVersion.
+func (b *fileBackend) SetFormatVersion(version int) {
+	b.formatVersion = version
+}
+
+func (b *fileBackend) saveToFile(filename string) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Use a buffered writer for better performance
+	writer := bufio.NewWriter(file)
+	defer writer.Flush()
+
+	// Convert sync.Map to a regular map for encoding
+	data := make(map[string]*NabiaRecord)
+	b.records.Range(func(key, value interface{}) bool {
+		data[key.(string)] = value.(*NabiaRecord)
+		return true
+	})
+
+	if b.formatVersion == 2 {
+		return writeFormatV2(writer, data)
+	}
+	return gob.NewEncoder(writer).Encode(data)
+}
+
+func (b *fileBackend) loadFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Use a buffered reader for better performance
+	reader := bufio.NewReader(file)
+
+	magic, err := reader.Peek(len(formatV2Magic))
+	if err == nil && bytes.Equal(magic, []byte(formatV2Magic)) {
+		return b.loadFromFileV2(reader)
+	}
+
+	// Fall back to the legacy whole-map gob snapshot, so databases written
+	// before format v2 existed still open.
+	data := make(map[string]*NabiaRecord)
+	if err := gob.NewDecoder(reader).Decode(&data); err != nil {
+		return err
+	}
+	for key, value := range data {
+		b.records.Store(key, value)
+	}
+	return nil
+}
+
+// loadFromFileV2 streams a format v2 snapshot, applying every record that
+// decodes and CRC-checks cleanly and logging a warning for every one that
+// doesn't instead of failing the whole load.
+func (b *fileBackend) loadFromFileV2(reader *bufio.Reader) error {
+	header := make([]byte, 16) // magic[4] + version + flags + reserved
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+
+	events, err := readFormatV2Records(reader, func(key string, rec *NabiaRecord) {
+		b.records.Store(key, rec)
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		log.Printf("engine: skipped corrupt record at offset %d: %s", event.Offset, event.Err)
+	}
+	return nil
+}
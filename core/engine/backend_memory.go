@@ -0,0 +1,42 @@
+package engine
+
+import "sync"
+
+// memoryBackend is a pure in-memory Backend with no persistence at all. It
+// exists mainly so tests (and the conformance harness in backend_test.go)
+// can exercise the Backend contract without touching the filesystem.
+type memoryBackend struct {
+	records sync.Map
+}
+
+func newMemoryBackend(_ string) (Backend, error) {
+	return &memoryBackend{}, nil
+}
+
+func (b *memoryBackend) Get(key string) (*NabiaRecord, bool) {
+	value, ok := b.records.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*NabiaRecord), true
+}
+
+func (b *memoryBackend) Put(key string, r *NabiaRecord) error {
+	b.records.Store(key, r)
+	return nil
+}
+
+func (b *memoryBackend) Delete(key string) error {
+	b.records.Delete(key)
+	return nil
+}
+
+func (b *memoryBackend) Range(fn func(key string, r *NabiaRecord) bool) {
+	b.records.Range(func(key, value interface{}) bool {
+		return fn(key.(string), value.(*NabiaRecord))
+	})
+}
+
+func (b *memoryBackend) Close() error {
+	return nil
+}
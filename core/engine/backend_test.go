@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// backendUnderTest builds a fresh, empty Backend of the given name rooted
+// in a temporary location. It registers the backend's Close (and removal
+// of its files) with t.Cleanup, so callers need no cleanup of their own.
+func backendUnderTest(t *testing.T, name string) Backend {
+	t.Helper()
+	factory, ok := lookupBackend(name)
+	if !ok {
+		t.Fatalf("no backend registered under %q", name)
+	}
+	location := filepath.Join(t.TempDir(), "conformance.db")
+	backend, err := factory(location)
+	if err != nil {
+		t.Fatalf("failed to construct %q backend: %s", name, err)
+	}
+	t.Cleanup(func() {
+		backend.Close()
+		os.RemoveAll(location)
+	})
+	return backend
+}
+
+// TestBackendConformance drives each backend named in the slice below
+// through the same set of behaviours, so new backends only need to be added
+// to this slice to be covered by the existing test matrix.
+func TestBackendConformance(t *testing.T) {
+	for _, name := range []string{"file", "memory", "bbolt"} {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			backend := backendUnderTest(t, name)
+
+			if _, ok := backend.Get("A"); ok {
+				t.Error("fresh backend should not contain any records")
+			}
+
+			record := NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")
+			if err := backend.Put("A", record); err != nil {
+				t.Fatalf("Put returned an unexpected error: %s", err)
+			}
+
+			got, ok := backend.Get("A")
+			if !ok {
+				t.Fatal("Get did not find a record that was just Put")
+			}
+			if string(got.RawData) != "Value_A" || got.ContentType != "text/plain; charset=UTF-8" {
+				t.Errorf("Get returned %+v, want %+v", got, record)
+			}
+
+			seen := make(map[string]bool)
+			backend.Range(func(key string, r *NabiaRecord) bool {
+				seen[key] = true
+				return true
+			})
+			if !seen["A"] {
+				t.Error("Range did not visit the record that was just Put")
+			}
+
+			if err := backend.Delete("A"); err != nil {
+				t.Fatalf("Delete returned an unexpected error: %s", err)
+			}
+			if _, ok := backend.Get("A"); ok {
+				t.Error("Get still finds a record after Delete")
+			}
+
+			// Deleting an already-absent key must be a no-op, not an error.
+			if err := backend.Delete("A"); err != nil {
+				t.Errorf("Delete on an absent key returned an error: %s", err)
+			}
+		})
+	}
+}
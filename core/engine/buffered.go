@@ -0,0 +1,313 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// defaultFlushMaxBytes is the buffer size BufferedDB starts with before
+// SetFlushPolicy is called.
+const defaultFlushMaxBytes = 4 << 20 // 4 MiB
+
+// bufferedEntry is one pending mutation inside a BufferedDB's buffer: either
+// a pending Put (record non-nil) or a pending Destroy (deleted true).
+type bufferedEntry struct {
+	record  *NabiaRecord
+	deleted bool
+	size    int
+}
+
+func entrySize(key string, r *NabiaRecord) int {
+	size := len(key)
+	if r != nil {
+		size += len(r.RawData) + len(r.ContentType)
+	}
+	return size
+}
+
+// BufferedDB sits in front of a slower Backend and absorbs bursts of writes
+// into a small in-memory buffer, following the "buffer wraps a backing
+// store" pattern: Put and Delete land in the buffer immediately and
+// return without touching the backend, Get consults the buffer first and
+// falls through to the backend on a miss, and Flush applies every buffered
+// mutation (including tombstones for deletes) to the backend in one batch.
+// This trades a window of buffered-but-not-yet-backed-up data for avoiding
+// an expensive backend write (e.g. an fsync) on every single call.
+//
+// BufferedDB implements Backend, so it can itself be registered as (or
+// nested inside) another backend.
+type BufferedDB struct {
+	mu      sync.Mutex
+	backend Backend
+	buffer  map[string]*bufferedEntry
+	bytes   int
+
+	maxBytes int
+	maxAge   time.Duration
+	ageTimer *time.Timer
+	flushing bool
+	closed   bool
+}
+
+// NewBufferedDB wraps backend with a buffer using the default flush policy
+// (4 MiB, no age-based flush). Use SetFlushPolicy to change it.
+func NewBufferedDB(backend Backend) *BufferedDB {
+	return &BufferedDB{
+		backend:  backend,
+		buffer:   make(map[string]*bufferedEntry),
+		maxBytes: defaultFlushMaxBytes,
+	}
+}
+
+func newBufferedBackend(location string) (Backend, error) {
+	inner, err := newFileBackend(location)
+	if err != nil {
+		return nil, err
+	}
+	return NewBufferedDB(inner), nil
+}
+
+func init() {
+	RegisterBackend("buffered", newBufferedBackend)
+}
+
+// SetFlushPolicy changes the thresholds that trigger an automatic
+// background Flush: once the buffer holds at least maxBytes of staged
+// data, and every maxAge on a timer that starts here and is rearmed after
+// each age-based flush. maxAge of zero disables age-based flushing.
+func (b *BufferedDB) SetFlushPolicy(maxBytes int, maxAge time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.maxBytes = maxBytes
+	b.maxAge = maxAge
+	if b.ageTimer != nil {
+		b.ageTimer.Stop()
+		b.ageTimer = nil
+	}
+	if maxAge > 0 {
+		b.ageTimer = time.AfterFunc(maxAge, b.ageFlush)
+	}
+}
+
+// ageFlush is the age timer's callback. It logs a failed Flush the way the
+// rest of the package reports background failures (see backend_file.go's
+// corrupt-record logging) rather than discarding the error, and rearms
+// itself so age-based flushing keeps firing for the rest of the BufferedDB's
+// life instead of only once.
+func (b *BufferedDB) ageFlush() {
+	if err := b.Flush(); err != nil {
+		log.Printf("engine: background age-based flush failed: %s", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || b.maxAge <= 0 {
+		return
+	}
+	b.ageTimer = time.AfterFunc(b.maxAge, b.ageFlush)
+}
+
+func (b *BufferedDB) Get(key string) (*NabiaRecord, bool) {
+	b.mu.Lock()
+	if entry, ok := b.buffer[key]; ok {
+		defer b.mu.Unlock()
+		if entry.deleted {
+			return nil, false
+		}
+		return entry.record, true
+	}
+	b.mu.Unlock()
+	return b.backend.Get(key)
+}
+
+func (b *BufferedDB) Put(key string, r *NabiaRecord) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return fmt.Errorf("engine: BufferedDB is closed")
+	}
+	b.setLocked(key, &bufferedEntry{record: r, size: entrySize(key, r)})
+	overThreshold := b.maxBytes > 0 && b.bytes >= b.maxBytes
+	b.mu.Unlock()
+
+	if overThreshold {
+		go func() {
+			if err := b.Flush(); err != nil {
+				log.Printf("engine: background size-triggered flush failed: %s", err)
+			}
+		}()
+	}
+	return nil
+}
+
+func (b *BufferedDB) Delete(key string) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return fmt.Errorf("engine: BufferedDB is closed")
+	}
+	b.setLocked(key, &bufferedEntry{deleted: true, size: entrySize(key, nil)})
+	overThreshold := b.maxBytes > 0 && b.bytes >= b.maxBytes
+	b.mu.Unlock()
+
+	if overThreshold {
+		go func() {
+			if err := b.Flush(); err != nil {
+				log.Printf("engine: background size-triggered flush failed: %s", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// setLocked replaces the buffered entry for key, keeping b.bytes accurate.
+// Callers must hold b.mu.
+func (b *BufferedDB) setLocked(key string, entry *bufferedEntry) {
+	if old, ok := b.buffer[key]; ok {
+		b.bytes -= old.size
+	}
+	b.buffer[key] = entry
+	b.bytes += entry.size
+}
+
+func (b *BufferedDB) Range(fn func(key string, r *NabiaRecord) bool) {
+	b.mu.Lock()
+	overlay := make(map[string]*bufferedEntry, len(b.buffer))
+	for key, entry := range b.buffer {
+		overlay[key] = entry
+	}
+	b.mu.Unlock()
+
+	visited := make(map[string]bool, len(overlay))
+	keepGoing := true
+	b.backend.Range(func(key string, r *NabiaRecord) bool {
+		if entry, ok := overlay[key]; ok {
+			visited[key] = true
+			if entry.deleted {
+				return true
+			}
+			keepGoing = fn(key, entry.record)
+			return keepGoing
+		}
+		keepGoing = fn(key, r)
+		return keepGoing
+	})
+	if !keepGoing {
+		return
+	}
+	for key, entry := range overlay {
+		if visited[key] || entry.deleted {
+			continue
+		}
+		if !fn(key, entry.record) {
+			return
+		}
+	}
+}
+
+// Flush applies every buffered mutation to the backend in one batch,
+// emptying the buffer. It is safe to call concurrently with Get/Put/
+// Delete and with itself (a Flush already in flight makes later calls a
+// no-op rather than racing over the same data twice).
+//
+// If applying to the backend fails partway through, whatever didn't make it
+// is merged back into the buffer instead of being silently dropped, so a
+// later Flush (or Close) gets another chance at it; entries written again
+// while this Flush was running take precedence over the stale ones being
+// restored.
+func (b *BufferedDB) Flush() error {
+	b.mu.Lock()
+	if b.flushing || len(b.buffer) == 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	b.flushing = true
+	pending := b.buffer
+	b.buffer = make(map[string]*bufferedEntry)
+	b.bytes = 0
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.flushing = false
+		b.mu.Unlock()
+	}()
+
+	applied, err := b.apply(pending)
+	if err != nil {
+		b.mu.Lock()
+		for key, entry := range pending {
+			if applied[key] {
+				continue
+			}
+			if _, ok := b.buffer[key]; !ok {
+				b.setLocked(key, entry)
+			}
+		}
+		b.mu.Unlock()
+	}
+	return err
+}
+
+// apply writes pending to the backend, in one batch if it supports
+// batchApplier. On success Flush ignores the applied set, since there's
+// nothing left to restore; on error it returns the keys that did
+// make it to the backend before the failure, so Flush knows what to keep out
+// of its restore.
+func (b *BufferedDB) apply(pending map[string]*bufferedEntry) (map[string]bool, error) {
+	if applier, ok := b.backend.(batchApplier); ok {
+		puts := make(map[string]*NabiaRecord)
+		deletes := make(map[string]struct{})
+		for key, entry := range pending {
+			if entry.deleted {
+				deletes[key] = struct{}{}
+			} else {
+				puts[key] = entry.record
+			}
+		}
+		if err := applier.ApplyBatch(puts, deletes); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	applied := make(map[string]bool, len(pending))
+	for key, entry := range pending {
+		var err error
+		if entry.deleted {
+			err = b.backend.Delete(key)
+		} else {
+			err = b.backend.Put(key, entry.record)
+		}
+		if err != nil {
+			return applied, err
+		}
+		applied[key] = true
+	}
+	return applied, nil
+}
+
+func (b *BufferedDB) Close() error {
+	b.mu.Lock()
+	if b.ageTimer != nil {
+		b.ageTimer.Stop()
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	// Flush is a no-op while a background Flush is in flight, so keep
+	// flushing until no flush is running and nothing is left buffered.
+	for {
+		if err := b.Flush(); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		done := !b.flushing && len(b.buffer) == 0
+		b.mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return b.backend.Close()
+}
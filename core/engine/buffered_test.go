@@ -0,0 +1,73 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBufferedDBReadsOwnWritesBeforeFlush(t *testing.T) {
+	backend, _ := newMemoryBackend("")
+	buffered := NewBufferedDB(backend)
+
+	record := NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")
+	if err := buffered.Put("A", record); err != nil {
+		t.Fatalf("Put returned an error: %s", err)
+	}
+
+	if _, ok := backend.Get("A"); ok {
+		t.Error("unflushed write should not be visible on the backing store yet")
+	}
+	got, ok := buffered.Get("A")
+	if !ok || string(got.RawData) != "Value_A" {
+		t.Errorf("Get should see the buffered write, got %+v, ok=%v", got, ok)
+	}
+
+	if err := buffered.Flush(); err != nil {
+		t.Fatalf("Flush returned an error: %s", err)
+	}
+	if _, ok := backend.Get("A"); !ok {
+		t.Error("Flush should have applied the write to the backing store")
+	}
+}
+
+func TestBufferedDBDeleteTombstonesFlush(t *testing.T) {
+	backend, _ := newMemoryBackend("")
+	backend.Put("A", NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8"))
+
+	buffered := NewBufferedDB(backend)
+	if err := buffered.Delete("A"); err != nil {
+		t.Fatalf("Delete returned an error: %s", err)
+	}
+	if _, ok := buffered.Get("A"); ok {
+		t.Error("deleted key should not be visible through the buffer")
+	}
+	if _, ok := backend.Get("A"); !ok {
+		t.Error("delete should not reach the backing store before Flush")
+	}
+
+	if err := buffered.Flush(); err != nil {
+		t.Fatalf("Flush returned an error: %s", err)
+	}
+	if _, ok := backend.Get("A"); ok {
+		t.Error("Flush should have applied the delete to the backing store")
+	}
+}
+
+func TestBufferedDBAutoFlushesPastSizeThreshold(t *testing.T) {
+	backend, _ := newMemoryBackend("")
+	buffered := NewBufferedDB(backend)
+	buffered.SetFlushPolicy(1, 0) // flush as soon as anything is buffered
+
+	if err := buffered.Put("A", NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")); err != nil {
+		t.Fatalf("Put returned an error: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := backend.Get("A"); ok {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("background flush did not apply the write in time")
+}
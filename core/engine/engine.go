@@ -1,11 +1,7 @@
 package engine
 
 import (
-	"bufio"
-	"encoding/gob"
 	"fmt"
-	"log"
-	"os"
 	"regexp"
 	"sync"
 )
@@ -15,6 +11,20 @@ type ContentType = string
 type NabiaRecord struct {
 	RawData     []byte
 	ContentType ContentType // "Content-Type" https://datatracker.ietf.org/doc/html/rfc2616/#section-14.17
+
+	// Kind is empty for ordinary inline records. It is "blob" for a pointer
+	// stub produced by WriteStream, in which case RawData is unused and the
+	// actual content lives in the content-addressed file BlobRef names; see
+	// stream.go.
+	Kind     string
+	BlobRef  string
+	BlobSize int64
+}
+
+var contentTypePattern = regexp.MustCompile(`^[a-zA-Z0-9]+/[a-zA-Z0-9]+`)
+
+func validContentType(ct ContentType) bool {
+	return contentTypePattern.MatchString(ct)
 }
 
 func NewNabiaString(s string) *NabiaRecord {
@@ -25,49 +35,137 @@ func NewNabiaRecord(data []byte, ct ContentType) *NabiaRecord {
 	return &NabiaRecord{RawData: data, ContentType: ct}
 }
 
+// NabiaDB is the database handle applications interact with. It delegates
+// all persistence to a Backend, chosen at construction time via Option; see
+// WithBackend.
 type NabiaDB struct {
-	Records  sync.Map
+	backend  Backend
 	location string
+
+	// writeMu guards the single writable Tx that may be open at a time; see
+	// Begin in tx.go.
+	writeMu sync.Mutex
+
+	// blobThreshold, blobRefs and blobRefsOnce support the streaming
+	// large-value API; see stream.go.
+	blobThreshold int64
+	blobMu        sync.Mutex
+	blobRefs      map[string]int
+	blobRefsOnce  sync.Once
 }
 
-// checkOrCreateDB checks if the file exists, and if it doesn't, it creates it.
-// The first boolean indicates whether the file already existed, and the second
-// boolean indicates whether an error occurred.
-func checkOrCreateFile(location string) (bool, error) {
-	// Attempt to open the file in read-only mode to check if it exists.
-	if _, err := os.Stat(location); err == nil {
-		// The file exists.
-		return true, nil
-	} else if os.IsNotExist(err) {
-		// The file does not exist, attempt to create it.
-		file, err := os.Create(location)
-		if err != nil {
-			// Failed to create the file, return the error.
-			return false, err
-		}
-		// Successfully created the file, close it.
-		defer file.Close()
-		return false, nil
-	} else {
-		// Some other error occurred when checking the file, return it.
-		return false, err
+// Option configures NewNabiaDB. See WithBackend.
+type Option func(*dbConfig)
+
+type dbConfig struct {
+	backendName   string
+	syncPolicy    *SyncPolicy
+	formatVersion int
+	blobThreshold int64
+}
+
+// WithBackend selects the storage backend NewNabiaDB should use, by the name
+// it was registered under with RegisterBackend. Built in are "file" (the
+// default, gob-snapshot-plus-sync.Map), "memory" (no persistence, handy for
+// tests), "bbolt" (crash-safe, backed by a bbolt B+tree) and "buffered" (a
+// BufferedDB in front of a "file" backend).
+func WithBackend(name string) Option {
+	return func(c *dbConfig) {
+		c.backendName = name
 	}
 }
 
-func NewNabiaDB(location string) (*NabiaDB, error) {
-	exists, err := checkOrCreateFile(location)
+// WithSyncPolicy controls how aggressively the backend's write-ahead log
+// fsyncs (see SyncAlways, SyncInterval and SyncNever). It has no effect on
+// backends that don't keep a WAL.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(c *dbConfig) {
+		c.syncPolicy = &policy
+	}
+}
+
+// syncPolicySetter is implemented by backends that keep a WAL and can have
+// its SyncPolicy changed after construction.
+type syncPolicySetter interface {
+	SetSyncPolicy(SyncPolicy)
+}
+
+// WithFormatVersion selects the on-disk snapshot format a backend writes:
+// version 1 is the legacy whole-map gob encoding every Nabia database has
+// used so far; version 2 (see format.go) frames each record individually
+// with its own CRC, so loads can stream and partially recover instead of
+// decoding the whole file as one gob blob. Backends that don't have a
+// versioned on-disk format ignore this option.
+func WithFormatVersion(version int) Option {
+	return func(c *dbConfig) {
+		c.formatVersion = version
+	}
+}
+
+// formatVersionSetter is implemented by backends with a versioned on-disk
+// snapshot format.
+type formatVersionSetter interface {
+	SetFormatVersion(version int)
+}
+
+// WithBlobThreshold sets the size, in bytes, above which WriteStream spills
+// a value to a content-addressed blob file instead of storing it inline.
+// Defaults to 1 MiB.
+func WithBlobThreshold(bytes int64) Option {
+	return func(c *dbConfig) {
+		c.blobThreshold = bytes
+	}
+}
+
+// Checkpointer is implemented by backends that can atomically fold their
+// write-ahead log back into the main snapshot. NabiaDB.Checkpoint uses it.
+type Checkpointer interface {
+	Checkpoint() error
+}
+
+func NewNabiaDB(location string, opts ...Option) (*NabiaDB, error) {
+	cfg := dbConfig{backendName: "file"}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	factory, ok := lookupBackend(cfg.backendName)
+	if !ok {
+		return nil, fmt.Errorf("engine: unknown backend %q", cfg.backendName)
+	}
+	backend, err := factory(location)
 	if err != nil {
 		return nil, err
 	}
-	ndb := &NabiaDB{Records: sync.Map{}, location: location}
-	if exists {
-		ndb.loadFromFile(location)
-	} else {
-		if err := ndb.saveToFile(location); err != nil {
-			log.Fatalf("Failed to save to file: %s", err)
+	if cfg.syncPolicy != nil {
+		if setter, ok := backend.(syncPolicySetter); ok {
+			setter.SetSyncPolicy(*cfg.syncPolicy)
 		}
 	}
-	return ndb, nil
+	if cfg.formatVersion != 0 {
+		if setter, ok := backend.(formatVersionSetter); ok {
+			setter.SetFormatVersion(cfg.formatVersion)
+		}
+	}
+	threshold := cfg.blobThreshold
+	if threshold == 0 {
+		threshold = defaultBlobThreshold
+	}
+	return &NabiaDB{backend: backend, location: location, blobThreshold: threshold}, nil
+}
+
+// Checkpoint folds the write-ahead log back into the main snapshot and
+// truncates it, on backends that support it (currently "file"). It returns
+// an error on backends without a WAL to fold.
+func (ns *NabiaDB) Checkpoint() error {
+	checkpointer, ok := ns.backend.(Checkpointer)
+	if !ok {
+		return fmt.Errorf("engine: backend does not support checkpoints")
+	}
+	// Hold writeMu so no write lands between the snapshot and the WAL
+	// truncation that follows it.
+	ns.writeMu.Lock()
+	defer ns.writeMu.Unlock()
+	return checkpointer.Checkpoint()
 }
 
 // Below are the DB primitives.
@@ -75,7 +173,7 @@ func NewNabiaDB(location string) (*NabiaDB, error) {
 // Exists checks if the key name provided exists in the Nabia map. It locks
 // to read and unlocks immediately after.
 func (ns *NabiaDB) Exists(key string) bool {
-	_, ok := ns.Records.Load(key)
+	_, ok := ns.backend.Get(key)
 	return ok
 }
 
@@ -85,12 +183,10 @@ func (ns *NabiaDB) Exists(key string) bool {
 // be used if the "error" field is not nil. This function is safe to call even
 // with empty data, because the method applies a mutex.
 func (ns *NabiaDB) Read(key string) (NabiaRecord, error) {
-	if value, ok := ns.Records.Load(key); ok {
-		record := value.(*NabiaRecord)
+	if record, ok := ns.backend.Get(key); ok {
 		return *record, nil
-	} else {
-		return NabiaRecord{}, fmt.Errorf("key '%s' doesn't exist", key)
 	}
+	return NabiaRecord{}, fmt.Errorf("key '%s' doesn't exist", key)
 }
 
 // Write takes the key and a value of NabiaRecord datatype and places it on the
@@ -106,72 +202,50 @@ func (ns *NabiaDB) Write(key string, value NabiaRecord) error {
 	if value.ContentType == "" {
 		return fmt.Errorf("Content-Type cannot be empty")
 	}
-	pattern := `^[a-zA-Z0-9]+/[a-zA-Z0-9]+`
-	r := regexp.MustCompile(pattern)
-	if !r.MatchString(value.ContentType) {
+	if !validContentType(value.ContentType) {
 		return fmt.Errorf("Content-Type is not valid")
-	} else {
-		ns.Records.Store(key, &value)
 	}
-	return nil
+	return ns.putRecord(key, value)
 }
 
 // Destroy takes a key and removes it from the map. This method doesn't have
 // existence-checking logic. It is safe to use on empty data, it simply doesn't
 // do anything if the record doesn't exist.
 func (ns *NabiaDB) Destroy(key string) {
-	ns.Records.Delete(key)
+	ns.writeMu.Lock()
+	defer ns.writeMu.Unlock()
+	old, _ := ns.backend.Get(key)
+	ns.backend.Delete(key)
+	ns.releaseBlobIfAny(old)
 }
 
-func (ns *NabiaDB) Stop() {
-	return
-}
-
-func (ns *NabiaDB) saveToFile(filename string) error {
-	file, err := os.Create(filename)
-	if err != nil {
+// putRecord applies value to the backend and, if it's overwriting a blob
+// stub, releases that blob's reference (see stream.go). It takes writeMu so
+// a direct Write/WriteStream can't race with an open writable Tx's eventual
+// Commit; see Begin in tx.go.
+func (ns *NabiaDB) putRecord(key string, value NabiaRecord) error {
+	ns.writeMu.Lock()
+	defer ns.writeMu.Unlock()
+	old, _ := ns.backend.Get(key)
+	if err := ns.backend.Put(key, &value); err != nil {
 		return err
 	}
-	defer file.Close()
-
-	// Use a buffered writer for better performance
-	writer := bufio.NewWriter(file)
-	defer writer.Flush()
-
-	encoder := gob.NewEncoder(writer)
-
-	// Convert sync.Map to a regular map for encoding
-	data := make(map[string]*NabiaRecord)
-	ns.Records.Range(func(key, value interface{}) bool {
-		data[key.(string)] = value.(*NabiaRecord)
-		return true
-	})
-
-	// Encode the map
-	return encoder.Encode(data)
+	ns.releaseBlobIfAny(old)
+	return nil
 }
 
-func (ns *NabiaDB) loadFromFile(filename string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-	defer file.Close()
-
-	// Use a buffered reader for better performance
-	reader := bufio.NewReader(file)
-	decoder := gob.NewDecoder(reader)
-
-	// Decode the map
-	data := make(map[string]*NabiaRecord)
-	if err := decoder.Decode(&data); err != nil {
-		return err
-	}
-
-	// Convert the regular map back to a sync.Map
-	for key, value := range data {
-		ns.Records.Store(key, value)
-	}
+// Range calls fn for every record currently stored, in no particular order,
+// stopping early if fn returns false. It is a thin pass-through to the
+// underlying Backend.
+func (ns *NabiaDB) Range(fn func(key string, r *NabiaRecord) bool) {
+	ns.backend.Range(fn)
+}
 
-	return nil
+// Stop closes the underlying backend, flushing any buffered writes and
+// fsyncing the WAL (or writing a final snapshot) as appropriate for the
+// backend in use. Callers should check the returned error; a failure here
+// means data written earlier in the process's life may not have made it to
+// disk.
+func (ns *NabiaDB) Stop() error {
+	return ns.backend.Close()
 }
@@ -0,0 +1,262 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Format v2 is a streamable alternative to the legacy whole-map gob
+// snapshot: a 16-byte header identifies it and carries a version so future
+// formats can keep sniffing their way in, and each record is individually
+// length-framed and CRC-checked so loadFromFile can stream records one at a
+// time (instead of holding the whole decoded map in memory) and skip a
+// corrupt record instead of failing the entire load.
+//
+//	header: magic[4]="NABI", version uint32, flags uint32, reserved uint32
+//	record: recordLen uint32, keyLen uint16, key, ctLen uint16, ct,
+//	        dataLen uint32, data, kindLen uint16, kind, blobRefLen uint16,
+//	        blobRef, blobSize uint64, crc32 uint32
+//	        (crc32 covers everything in the record after recordLen)
+//	footer: recordLen=0 sentinel, followed by a uint64 total record count
+const (
+	formatV2Magic   = "NABI"
+	formatV2Version = uint32(2)
+
+	// crc32Size is the width of the trailing checksum on every record.
+	crc32Size = 4
+)
+
+// RecoveryEvent describes one record a format v2 (or legacy gob) load had to
+// skip because it was corrupt or truncated.
+type RecoveryEvent struct {
+	Key    string
+	Offset int64
+	Err    error
+}
+
+func writeFormatV2Header(buf *bytes.Buffer, flags uint32) error {
+	buf.WriteString(formatV2Magic)
+	if err := binary.Write(buf, binary.BigEndian, formatV2Version); err != nil {
+		return err
+	}
+	if err := binary.Write(buf, binary.BigEndian, flags); err != nil {
+		return err
+	}
+	return binary.Write(buf, binary.BigEndian, uint32(0)) // reserved
+}
+
+// encodeRecordV2 frames key/r as one format v2 record: recordLen, payload,
+// crc32. The payload carries every NabiaRecord field, including the
+// Kind/BlobRef/BlobSize that mark a blob stub (see stream.go), so a stub
+// round-trips through a snapshot exactly as it was written.
+func encodeRecordV2(key string, r *NabiaRecord) ([]byte, error) {
+	var payload bytes.Buffer
+	if len(key) > 0xFFFF {
+		return nil, fmt.Errorf("engine: key %q too long for format v2", key)
+	}
+	if err := binary.Write(&payload, binary.BigEndian, uint16(len(key))); err != nil {
+		return nil, err
+	}
+	payload.WriteString(key)
+	if len(r.ContentType) > 0xFFFF {
+		return nil, fmt.Errorf("engine: Content-Type for key %q too long for format v2", key)
+	}
+	if err := binary.Write(&payload, binary.BigEndian, uint16(len(r.ContentType))); err != nil {
+		return nil, err
+	}
+	payload.WriteString(r.ContentType)
+	if err := binary.Write(&payload, binary.BigEndian, uint32(len(r.RawData))); err != nil {
+		return nil, err
+	}
+	payload.Write(r.RawData)
+	if len(r.Kind) > 0xFFFF {
+		return nil, fmt.Errorf("engine: Kind for key %q too long for format v2", key)
+	}
+	if err := binary.Write(&payload, binary.BigEndian, uint16(len(r.Kind))); err != nil {
+		return nil, err
+	}
+	payload.WriteString(r.Kind)
+	if len(r.BlobRef) > 0xFFFF {
+		return nil, fmt.Errorf("engine: BlobRef for key %q too long for format v2", key)
+	}
+	if err := binary.Write(&payload, binary.BigEndian, uint16(len(r.BlobRef))); err != nil {
+		return nil, err
+	}
+	payload.WriteString(r.BlobRef)
+	if err := binary.Write(&payload, binary.BigEndian, uint64(r.BlobSize)); err != nil {
+		return nil, err
+	}
+
+	sum := crc32.ChecksumIEEE(payload.Bytes())
+
+	var record bytes.Buffer
+	if err := binary.Write(&record, binary.BigEndian, uint32(payload.Len()+crc32Size)); err != nil {
+		return nil, err
+	}
+	record.Write(payload.Bytes())
+	if err := binary.Write(&record, binary.BigEndian, sum); err != nil {
+		return nil, err
+	}
+	return record.Bytes(), nil
+}
+
+// writeFormatV2 writes every record in data to w in format v2.
+func writeFormatV2(w io.Writer, data map[string]*NabiaRecord) error {
+	var header bytes.Buffer
+	if err := writeFormatV2Header(&header, 0); err != nil {
+		return err
+	}
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+
+	for key, record := range data {
+		encoded, err := encodeRecordV2(key, record)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(encoded); err != nil {
+			return err
+		}
+	}
+
+	var footer bytes.Buffer
+	if err := binary.Write(&footer, binary.BigEndian, uint32(0)); err != nil { // sentinel
+		return err
+	}
+	if err := binary.Write(&footer, binary.BigEndian, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := w.Write(footer.Bytes())
+	return err
+}
+
+// decodeRecordPayloadV2 parses the keyLen/key/ctLen/ct/dataLen/data/
+// kindLen/kind/blobRefLen/blobRef/blobSize fields out of a format v2
+// record's payload (i.e. everything between recordLen
+// and the trailing crc32).
+func decodeRecordPayloadV2(payload []byte) (string, *NabiaRecord, error) {
+	r := bytes.NewReader(payload)
+
+	var keyLen uint16
+	if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+
+	var ctLen uint16
+	if err := binary.Read(r, binary.BigEndian, &ctLen); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+	ct := make([]byte, ctLen)
+	if _, err := io.ReadFull(r, ct); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+
+	var dataLen uint32
+	if err := binary.Read(r, binary.BigEndian, &dataLen); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+
+	var kindLen uint16
+	if err := binary.Read(r, binary.BigEndian, &kindLen); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+	kind := make([]byte, kindLen)
+	if _, err := io.ReadFull(r, kind); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+
+	var blobRefLen uint16
+	if err := binary.Read(r, binary.BigEndian, &blobRefLen); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+	blobRef := make([]byte, blobRefLen)
+	if _, err := io.ReadFull(r, blobRef); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+
+	var blobSize uint64
+	if err := binary.Read(r, binary.BigEndian, &blobSize); err != nil {
+		return "", nil, fmt.Errorf("engine: malformed record: %w", err)
+	}
+
+	if r.Len() != 0 {
+		return "", nil, fmt.Errorf("engine: malformed record: %d trailing bytes", r.Len())
+	}
+	return string(key), &NabiaRecord{
+		RawData:     data,
+		ContentType: string(ct),
+		Kind:        string(kind),
+		BlobRef:     string(blobRef),
+		BlobSize:    int64(blobSize),
+	}, nil
+}
+
+// readFormatV2Records streams records out of r (positioned right after the
+// header) calling put for each one that decodes and CRC-checks cleanly.
+// Records that fail their CRC, or are malformed, are reported as
+// RecoveryEvents and skipped rather than aborting the whole load; only a
+// truncated recordLen/record (a torn write at EOF) stops the stream early.
+func readFormatV2Records(r io.Reader, put func(key string, rec *NabiaRecord)) ([]RecoveryEvent, error) {
+	var events []RecoveryEvent
+	var offset int64 = 16 // size of the header the caller already consumed
+
+	for {
+		var recordLen uint32
+		if err := binary.Read(r, binary.BigEndian, &recordLen); err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return events, nil // truncated length prefix: torn write, stop here
+		}
+		offset += 4
+
+		if recordLen == 0 {
+			// Sentinel: the footer's record count follows, then EOF.
+			var count uint64
+			binary.Read(r, binary.BigEndian, &count)
+			return events, nil
+		}
+
+		buf := make([]byte, recordLen)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			events = append(events, RecoveryEvent{Offset: offset, Err: fmt.Errorf("engine: truncated record: %w", err)})
+			return events, nil
+		}
+		offset += int64(recordLen)
+
+		// A record too short to even hold its trailing crc32 is corrupt
+		// framing, not a torn write: we read exactly the bytes recordLen
+		// promised, so the stream is still aligned and we can skip to the
+		// next record instead of aborting the whole load.
+		if len(buf) < crc32Size {
+			events = append(events, RecoveryEvent{Offset: offset, Err: fmt.Errorf("engine: record too short (%d bytes), record skipped", len(buf))})
+			continue
+		}
+
+		payload, crcBytes := buf[:len(buf)-4], buf[len(buf)-4:]
+		wantSum := binary.BigEndian.Uint32(crcBytes)
+		if crc32.ChecksumIEEE(payload) != wantSum {
+			events = append(events, RecoveryEvent{Offset: offset, Err: fmt.Errorf("engine: crc32 mismatch, record skipped")})
+			continue
+		}
+
+		key, rec, err := decodeRecordPayloadV2(payload)
+		if err != nil {
+			events = append(events, RecoveryEvent{Key: key, Offset: offset, Err: err})
+			continue
+		}
+		put(key, rec)
+	}
+}
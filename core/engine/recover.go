@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RecoverFile opens a Nabia database file that may be partially corrupt,
+// salvaging every record it can decode and reporting the rest instead of
+// failing the whole load the way NewNabiaDB/loadFromFile does, modeled on
+// goleveldb's RecoverFile. It always hands back a usable *NabiaDB backed by
+// whatever records survived, even if that's none.
+//
+// How much survives a corrupt file depends on the snapshot format: format
+// v2 frames each record individually, so corruption only costs the records
+// it actually touches (see recoverFormatV2). The legacy whole-map gob format
+// has no such framing, so corruption anywhere in it loses the entire
+// snapshot (see recoverLegacyGob) — WAL replay on top still recovers
+// whatever mutations happened since that snapshot was written.
+func RecoverFile(location string) (*NabiaDB, []RecoveryEvent, error) {
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	data, events, err := recoverSnapshot(reader)
+	file.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	backend := &fileBackend{location: location, formatVersion: 1}
+	for key, record := range data {
+		backend.records.Store(key, record)
+	}
+
+	w, err := openWAL(walLocation(location), SyncAlways())
+	if err != nil {
+		return nil, nil, err
+	}
+	backend.wal = w
+
+	// Replay whatever valid trailing WAL records exist on top of the
+	// salvaged snapshot; walReplay already stops cleanly at the first torn
+	// record, so nothing further to report here.
+	if err := walReplay(walLocation(location),
+		func(key string, r *NabiaRecord) { backend.records.Store(key, r) },
+		func(key string) { backend.records.Delete(key) },
+	); err != nil {
+		return nil, nil, err
+	}
+
+	return &NabiaDB{backend: backend, location: location, blobThreshold: defaultBlobThreshold}, events, nil
+}
+
+// recoverSnapshot salvages as many records as possible out of a (possibly
+// corrupt) snapshot file, sniffing the format the same way loadFromFile
+// does.
+func recoverSnapshot(reader *bufio.Reader) (map[string]*NabiaRecord, []RecoveryEvent, error) {
+	magic, err := reader.Peek(len(formatV2Magic))
+	if err == nil && bytes.Equal(magic, []byte(formatV2Magic)) {
+		return recoverFormatV2(reader)
+	}
+	return recoverLegacyGob(reader)
+}
+
+func recoverFormatV2(reader *bufio.Reader) (map[string]*NabiaRecord, []RecoveryEvent, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, fmt.Errorf("engine: cannot recover: %w", err)
+	}
+	data := make(map[string]*NabiaRecord)
+	events, err := readFormatV2Records(reader, func(key string, rec *NabiaRecord) {
+		data[key] = rec
+	})
+	return data, events, err
+}
+
+// recoverLegacyGob decodes a legacy whole-map gob snapshot. Unlike format v2
+// (see format.go), the legacy format has no per-record framing: it's one
+// gob-encoded map, and a decode error partway through (the "gob: unexpected
+// EOF" a truncated or corrupt file produces) does not leave the entries
+// decoded before the break sitting in data — gob does not populate the
+// destination map until the whole value decodes cleanly. So unlike format
+// v2, legacy recovery is all-or-nothing: a clean decode returns everything,
+// and a failed one can only report the loss, not salvage a partial map.
+func recoverLegacyGob(reader *bufio.Reader) (map[string]*NabiaRecord, []RecoveryEvent, error) {
+	data := make(map[string]*NabiaRecord)
+	if err := gob.NewDecoder(reader).Decode(&data); err != nil {
+		return map[string]*NabiaRecord{}, []RecoveryEvent{{Err: fmt.Errorf("engine: legacy gob snapshot is corrupt and cannot be partially recovered: %w", err)}}, nil
+	}
+	return data, nil, nil
+}
@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverFileSalvagesFormatV2(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "recover.db")
+
+	db, err := NewNabiaDB(location, WithFormatVersion(2))
+	if err != nil {
+		t.Fatalf("failed to create NabiaDB: %s", err)
+	}
+	if err := db.Write("A", *NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	if err := db.Write("B", *NewNabiaRecord([]byte("Value_B"), "text/plain; charset=UTF-8")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	db.Stop()
+
+	// Corrupt a byte inside the second record's payload to simulate disk
+	// corruption, without touching the first record.
+	raw, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %s", err)
+	}
+	corruptAt := bytes.LastIndex(raw, []byte("Value_B"))
+	if corruptAt < 0 {
+		t.Fatal("could not find Value_B in the snapshot to corrupt")
+	}
+	raw[corruptAt] ^= 0xFF
+	if err := os.WriteFile(location, raw, 0600); err != nil {
+		t.Fatalf("failed to write back corrupted snapshot: %s", err)
+	}
+
+	recovered, events, err := RecoverFile(location)
+	if err != nil {
+		t.Fatalf("RecoverFile returned an error: %s", err)
+	}
+	defer recovered.Stop()
+
+	if len(events) == 0 {
+		t.Error("expected at least one recovery event for the corrupted record")
+	}
+	got, err := recovered.Read("A")
+	if err != nil || string(got.RawData) != "Value_A" {
+		t.Errorf("expected uncorrupted record A to survive recovery, got %v, err=%s", got, err)
+	}
+}
+
+// TestRecoverFileLegacyGobIsAllOrNothing documents that, unlike format v2,
+// a truncated legacy (format version 1, the default) snapshot cannot be
+// partially salvaged: gob only populates its destination map on a fully
+// clean decode, so any corruption loses the whole snapshot, not just the
+// record it touches. WAL replay on top of that empty snapshot still
+// recovers whatever mutations happened since the snapshot was last written.
+func TestRecoverFileLegacyGobIsAllOrNothing(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "recover-legacy.db")
+
+	db, err := NewNabiaDB(location)
+	if err != nil {
+		t.Fatalf("failed to create NabiaDB: %s", err)
+	}
+	if err := db.Write("A", *NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+	db.Stop()
+
+	raw, err := os.ReadFile(location)
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %s", err)
+	}
+	if err := os.WriteFile(location, raw[:len(raw)/2], 0600); err != nil {
+		t.Fatalf("failed to write back truncated snapshot: %s", err)
+	}
+
+	recovered, events, err := RecoverFile(location)
+	if err != nil {
+		t.Fatalf("RecoverFile returned an error: %s", err)
+	}
+	defer recovered.Stop()
+
+	if len(events) != 1 {
+		t.Fatalf("expected exactly one recovery event for the truncated legacy snapshot, got %+v", events)
+	}
+	if recovered.Exists("A") {
+		t.Error("a truncated legacy gob snapshot should not partially recover any records")
+	}
+}
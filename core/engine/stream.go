@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// defaultBlobThreshold is the value above which WriteStream spills to a
+// blob file, unless overridden with WithBlobThreshold.
+const defaultBlobThreshold = 1 << 20 // 1 MiB
+
+// blobKind marks a NabiaRecord as a pointer stub to a content-addressed
+// blob file rather than holding its data inline.
+const blobKind = "blob"
+
+func blobsDir(location string) string {
+	return location + ".blobs"
+}
+
+func blobPath(location, ref string) string {
+	return filepath.Join(blobsDir(location), ref)
+}
+
+// WriteStream returns a Writer that streams a value for key into the
+// database without ever holding the whole value in memory at once. Once the
+// caller has written everything and calls Close, the value is committed:
+// values at or under the configured blob threshold (see WithBlobThreshold)
+// are kept inline exactly like Write would store them; larger values spill
+// to a content-addressed file under "<location>.blobs/<sha256>", and the
+// map only holds a small pointer stub.
+func (ns *NabiaDB) WriteStream(key string, ct ContentType) (io.WriteCloser, error) {
+	if key == "" {
+		return nil, fmt.Errorf("key cannot be empty")
+	}
+	if ct == "" {
+		return nil, fmt.Errorf("Content-Type cannot be empty")
+	}
+	if !validContentType(ct) {
+		return nil, fmt.Errorf("Content-Type is not valid")
+	}
+	if err := os.MkdirAll(blobsDir(ns.location), 0700); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(blobsDir(ns.location), "stream-*")
+	if err != nil {
+		return nil, err
+	}
+	return &streamWriter{ns: ns, key: key, ct: ct, file: tmp, hash: sha256.New()}, nil
+}
+
+type streamWriter struct {
+	ns     *NabiaDB
+	key    string
+	ct     ContentType
+	file   *os.File
+	hash   hash.Hash
+	size   int64
+	closed bool
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	if n > 0 {
+		s.hash.Write(p[:n])
+		s.size += int64(n)
+	}
+	return n, err
+}
+
+// Close commits the streamed value. It is safe to call more than once; only
+// the first call has any effect.
+func (s *streamWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	tmpName := s.file.Name()
+	defer os.Remove(tmpName) // no-op once the rename below has moved it
+
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+
+	if s.size <= s.ns.blobThreshold {
+		data, err := os.ReadFile(tmpName)
+		if err != nil {
+			return err
+		}
+		return s.ns.putRecord(s.key, NabiaRecord{RawData: data, ContentType: s.ct})
+	}
+
+	ref := hex.EncodeToString(s.hash.Sum(nil))
+	dest := blobPath(s.ns.location, ref)
+	if _, err := os.Stat(dest); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(tmpName, dest); err != nil {
+			return err
+		}
+	}
+	// else: another key already wrote this exact content; dedup by keeping
+	// that copy and dropping ours (the deferred os.Remove above).
+
+	return s.ns.writeBlobStub(s.key, s.ct, ref, s.size)
+}
+
+// ReadStream returns a Reader over the value stored under key, without
+// materializing it as a []byte first. Works for both inline and spilled
+// (blob) values.
+func (ns *NabiaDB) ReadStream(key string) (io.ReadCloser, ContentType, error) {
+	record, err := ns.Read(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if record.Kind != blobKind {
+		return io.NopCloser(bytes.NewReader(record.RawData)), record.ContentType, nil
+	}
+	file, err := os.Open(blobPath(ns.location, record.BlobRef))
+	if err != nil {
+		return nil, "", err
+	}
+	return file, record.ContentType, nil
+}
+
+// writeBlobStub stores a pointer-stub record for key and registers a new
+// reference to ref. The reference is counted before the stub is stored:
+// ensureBlobRefs lazily rebuilds its table by scanning the backend, and if
+// that scan ran after putRecord it would already see this stub and count it
+// once on its own, then again here.
+func (ns *NabiaDB) writeBlobStub(key string, ct ContentType, ref string, size int64) error {
+	ns.incrBlobRef(ref)
+	if err := ns.putRecord(key, NabiaRecord{ContentType: ct, Kind: blobKind, BlobRef: ref, BlobSize: size}); err != nil {
+		ns.decrBlobRef(ref)
+		return err
+	}
+	return nil
+}
+
+// releaseBlobIfAny drops the reference old (the record a key used to hold)
+// had on its blob, if it was a blob stub. Called whenever a key is
+// overwritten or destroyed.
+func (ns *NabiaDB) releaseBlobIfAny(old *NabiaRecord) {
+	if old == nil || old.Kind != blobKind {
+		return
+	}
+	ns.decrBlobRef(old.BlobRef)
+}
+
+// ensureBlobRefs lazily builds the in-memory refcount table the first time
+// it's needed, by scanning every blob stub currently in the database. This
+// lets refcounting work correctly even for blobs written in a previous
+// process.
+func (ns *NabiaDB) ensureBlobRefs() {
+	ns.blobRefsOnce.Do(func() {
+		ns.blobMu.Lock()
+		defer ns.blobMu.Unlock()
+		ns.blobRefs = make(map[string]int)
+		ns.backend.Range(func(key string, r *NabiaRecord) bool {
+			if r.Kind == blobKind {
+				ns.blobRefs[r.BlobRef]++
+			}
+			return true
+		})
+	})
+}
+
+func (ns *NabiaDB) incrBlobRef(ref string) {
+	ns.ensureBlobRefs()
+	ns.blobMu.Lock()
+	defer ns.blobMu.Unlock()
+	ns.blobRefs[ref]++
+}
+
+// decrBlobRef drops one reference to ref, unlinking the blob file once its
+// count reaches zero.
+func (ns *NabiaDB) decrBlobRef(ref string) {
+	ns.ensureBlobRefs()
+	ns.blobMu.Lock()
+	count, ok := ns.blobRefs[ref]
+	if !ok {
+		ns.blobMu.Unlock()
+		return
+	}
+	count--
+	if count <= 0 {
+		delete(ns.blobRefs, ref)
+	} else {
+		ns.blobRefs[ref] = count
+	}
+	ns.blobMu.Unlock()
+
+	if count <= 0 {
+		os.Remove(blobPath(ns.location, ref))
+	}
+}
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStreamInlineForSmallValues(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "stream.db")
+	db, err := NewNabiaDB(location, WithBackend("memory"))
+	if err != nil {
+		t.Fatalf("failed to create NabiaDB: %s", err)
+	}
+	defer db.Stop()
+
+	w, err := db.WriteStream("A", "text/plain; charset=UTF-8")
+	if err != nil {
+		t.Fatalf("WriteStream returned an error: %s", err)
+	}
+	if _, err := io.WriteString(w, "small value"); err != nil {
+		t.Fatalf("failed to write to stream: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close stream: %s", err)
+	}
+
+	record, err := db.Read("A")
+	if err != nil {
+		t.Fatalf("failed to read back A: %s", err)
+	}
+	if record.Kind == blobKind {
+		t.Error("a small streamed value should be stored inline, not as a blob stub")
+	}
+	if string(record.RawData) != "small value" {
+		t.Errorf("got %q, want %q", record.RawData, "small value")
+	}
+
+	r, ct, err := db.ReadStream("A")
+	if err != nil {
+		t.Fatalf("ReadStream returned an error: %s", err)
+	}
+	defer r.Close()
+	if ct != "text/plain; charset=UTF-8" {
+		t.Errorf("got Content-Type %q, want %q", ct, "text/plain; charset=UTF-8")
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != "small value" {
+		t.Errorf("ReadStream returned %q, err=%s", got, err)
+	}
+}
+
+func TestWriteStreamSpillsLargeValuesToBlob(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "stream-blob.db")
+	db, err := NewNabiaDB(location, WithBackend("memory"), WithBlobThreshold(4))
+	if err != nil {
+		t.Fatalf("failed to create NabiaDB: %s", err)
+	}
+	defer db.Stop()
+
+	w, err := db.WriteStream("A", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("WriteStream returned an error: %s", err)
+	}
+	if _, err := io.WriteString(w, "this is bigger than the threshold"); err != nil {
+		t.Fatalf("failed to write to stream: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close stream: %s", err)
+	}
+
+	record, err := db.Read("A")
+	if err != nil {
+		t.Fatalf("failed to read back A: %s", err)
+	}
+	if record.Kind != blobKind {
+		t.Fatal("a value over the threshold should be stored as a blob stub")
+	}
+	if _, err := os.Stat(blobPath(location, record.BlobRef)); err != nil {
+		t.Errorf("expected blob file to exist: %s", err)
+	}
+
+	r, _, err := db.ReadStream("A")
+	if err != nil {
+		t.Fatalf("ReadStream returned an error: %s", err)
+	}
+	defer r.Close()
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, []byte("this is bigger than the threshold")) {
+		t.Errorf("ReadStream returned %q, err=%s", got, err)
+	}
+
+	db.Destroy("A")
+	if _, err := os.Stat(blobPath(location, record.BlobRef)); !os.IsNotExist(err) {
+		t.Error("blob file should be unlinked once its last reference is destroyed")
+	}
+}
@@ -0,0 +1,215 @@
+package engine
+
+import (
+	"fmt"
+)
+
+// txEntry is one overlay entry inside a writable Tx: either a pending Put
+// (record non-nil) or a pending Destroy (deleted true).
+type txEntry struct {
+	record  *NabiaRecord
+	deleted bool
+}
+
+// Tx is a transaction over a NabiaDB, modeled on bbolt's read/write
+// transactions. A writable Tx buffers its writes and deletes in an overlay
+// and only applies them to the backend on Commit; a read-only Tx instead
+// observes a frozen snapshot of the database taken at Begin, so concurrent
+// writers can't change what it sees mid-transaction.
+type Tx struct {
+	db       *NabiaDB
+	writable bool
+
+	// overlay holds pending mutations for a writable Tx. Reads check it
+	// first, then fall back to the live backend.
+	overlay map[string]*txEntry
+
+	// snapshot holds the frozen committed state a read-only Tx sees. It's
+	// populated once, at Begin, by copying every record out of the backend.
+	snapshot map[string]*NabiaRecord
+
+	done bool
+}
+
+// Begin starts a new transaction. Only one writable Tx may be open on a
+// NabiaDB at a time; Begin(true) blocks until any other writable Tx
+// finishes. Any number of read-only transactions may be open concurrently,
+// each seeing its own stable snapshot of the committed state.
+func (ns *NabiaDB) Begin(writable bool) (*Tx, error) {
+	tx := &Tx{db: ns, writable: writable}
+	if writable {
+		ns.writeMu.Lock()
+		tx.overlay = make(map[string]*txEntry)
+		return tx, nil
+	}
+
+	// Eager snapshot: take a private copy of every key so the
+	// transaction's view can't change underneath it once Begin returns.
+	snapshot := make(map[string]*NabiaRecord)
+	ns.backend.Range(func(key string, r *NabiaRecord) bool {
+		snapshot[key] = r
+		return true
+	})
+	tx.snapshot = snapshot
+	return tx, nil
+}
+
+// Read looks up key, seeing this Tx's own uncommitted writes (if writable)
+// on top of the snapshot it was started with.
+func (tx *Tx) Read(key string) (NabiaRecord, error) {
+	if tx.done {
+		return NabiaRecord{}, fmt.Errorf("engine: transaction already closed")
+	}
+	if tx.writable {
+		if entry, ok := tx.overlay[key]; ok {
+			if entry.deleted {
+				return NabiaRecord{}, fmt.Errorf("key '%s' doesn't exist", key)
+			}
+			return *entry.record, nil
+		}
+		return tx.db.Read(key)
+	}
+	if record, ok := tx.snapshot[key]; ok {
+		return *record, nil
+	}
+	return NabiaRecord{}, fmt.Errorf("key '%s' doesn't exist", key)
+}
+
+// Exists reports whether key is visible to this Tx.
+func (tx *Tx) Exists(key string) bool {
+	_, err := tx.Read(key)
+	return err == nil
+}
+
+// Write stages a Put for key, visible to this Tx's own Read calls but not
+// applied to the database until Commit.
+func (tx *Tx) Write(key string, value NabiaRecord) error {
+	if !tx.writable {
+		return fmt.Errorf("engine: transaction is read-only")
+	}
+	if tx.done {
+		return fmt.Errorf("engine: transaction already closed")
+	}
+	tx.overlay[key] = &txEntry{record: &value}
+	return nil
+}
+
+// Destroy stages a delete for key.
+func (tx *Tx) Destroy(key string) error {
+	if !tx.writable {
+		return fmt.Errorf("engine: transaction is read-only")
+	}
+	if tx.done {
+		return fmt.Errorf("engine: transaction already closed")
+	}
+	tx.overlay[key] = &txEntry{deleted: true}
+	return nil
+}
+
+// Commit applies every staged write and delete to the database. On backends
+// that implement batchApplier they go in as one batch; on others they are
+// applied one at a time, and a failure partway through leaves the mutations
+// applied before it in place. For a read-only Tx, Commit just releases the
+// snapshot.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return fmt.Errorf("engine: transaction already closed")
+	}
+	tx.done = true
+	if !tx.writable {
+		return nil
+	}
+	defer tx.db.writeMu.Unlock()
+	return tx.db.applyOverlay(tx.overlay)
+}
+
+// Rollback discards every staged write and delete. It is safe to call
+// Rollback after Commit has already run; it's then a no-op, which lets
+// callers `defer tx.Rollback()` unconditionally.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return nil
+	}
+	tx.done = true
+	if tx.writable {
+		tx.db.writeMu.Unlock()
+	}
+	return nil
+}
+
+// applyOverlay commits a writable Tx's overlay to the backend as a single
+// batch. Backends that keep a WAL (see batchApplier) fold it into one
+// fsync; others just apply each mutation in turn. Like putRecord/Destroy, it
+// releases the blob reference (see stream.go) held by whatever record used
+// to be at each key, so destroying or overwriting a blob stub through a Tx
+// doesn't leak the blob file the way going straight to the backend would.
+func (ns *NabiaDB) applyOverlay(overlay map[string]*txEntry) error {
+	olds := make(map[string]*NabiaRecord, len(overlay))
+	for key := range overlay {
+		old, _ := ns.backend.Get(key)
+		olds[key] = old
+	}
+
+	if applier, ok := ns.backend.(batchApplier); ok {
+		puts := make(map[string]*NabiaRecord)
+		deletes := make(map[string]struct{})
+		for key, entry := range overlay {
+			if entry.deleted {
+				deletes[key] = struct{}{}
+			} else {
+				puts[key] = entry.record
+			}
+		}
+		if err := applier.ApplyBatch(puts, deletes); err != nil {
+			return err
+		}
+		for _, old := range olds {
+			ns.releaseBlobIfAny(old)
+		}
+		return nil
+	}
+	for key, entry := range overlay {
+		if entry.deleted {
+			if err := ns.backend.Delete(key); err != nil {
+				return err
+			}
+		} else {
+			if err := ns.backend.Put(key, entry.record); err != nil {
+				return err
+			}
+		}
+		ns.releaseBlobIfAny(olds[key])
+	}
+	return nil
+}
+
+// batchApplier is implemented by backends that can apply a set of puts and
+// deletes as a single atomic unit (e.g. one WAL fsync instead of one per
+// mutation).
+type batchApplier interface {
+	ApplyBatch(puts map[string]*NabiaRecord, deletes map[string]struct{}) error
+}
+
+// Update runs fn inside a writable transaction, committing on success and
+// rolling back if fn returns an error.
+func (ns *NabiaDB) Update(fn func(*Tx) error) error {
+	tx, err := ns.Begin(true)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// View runs fn inside a read-only transaction.
+func (ns *NabiaDB) View(fn func(*Tx) error) error {
+	tx, err := ns.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestTxUpdateCommitsAtomically(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "tx.db")
+	db, err := NewNabiaDB(location, WithBackend("memory"))
+	if err != nil {
+		t.Fatalf("failed to create NabiaDB: %s", err)
+	}
+	defer db.Stop()
+
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Write("A", *NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")); err != nil {
+			return err
+		}
+		return tx.Write("B", *NewNabiaRecord([]byte("Value_B"), "text/plain; charset=UTF-8"))
+	})
+	if err != nil {
+		t.Fatalf("Update returned an error: %s", err)
+	}
+	if !db.Exists("A") || !db.Exists("B") {
+		t.Error("both writes inside the transaction should be visible after Commit")
+	}
+}
+
+func TestTxUpdateRollsBackOnError(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "tx-rollback.db")
+	db, err := NewNabiaDB(location, WithBackend("memory"))
+	if err != nil {
+		t.Fatalf("failed to create NabiaDB: %s", err)
+	}
+	defer db.Stop()
+
+	wantErr := fmt.Errorf("boom")
+	err = db.Update(func(tx *Tx) error {
+		if err := tx.Write("A", *NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")); err != nil {
+			return err
+		}
+		return wantErr
+	})
+	if err != wantErr {
+		t.Fatalf("expected Update to surface the callback's error, got %v", err)
+	}
+	if db.Exists("A") {
+		t.Error("write staged in a rolled-back transaction should not be visible")
+	}
+}
+
+func TestTxViewSeesStableSnapshot(t *testing.T) {
+	location := filepath.Join(t.TempDir(), "tx-view.db")
+	db, err := NewNabiaDB(location, WithBackend("memory"))
+	if err != nil {
+		t.Fatalf("failed to create NabiaDB: %s", err)
+	}
+	defer db.Stop()
+
+	if err := db.Write("A", *NewNabiaRecord([]byte("Value_A"), "text/plain; charset=UTF-8")); err != nil {
+		t.Fatalf("failed to write: %s", err)
+	}
+
+	err = db.View(func(tx *Tx) error {
+		if !tx.Exists("A") {
+			t.Error("read-only transaction should see data committed before Begin")
+		}
+		// A write landing after the snapshot was taken must not appear
+		// inside the already-open read-only transaction.
+		if err := db.Write("B", *NewNabiaRecord([]byte("Value_B"), "text/plain; charset=UTF-8")); err != nil {
+			t.Fatalf("failed to write: %s", err)
+		}
+		if tx.Exists("B") {
+			t.Error("read-only transaction should not see writes committed after Begin")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("View returned an error: %s", err)
+	}
+}
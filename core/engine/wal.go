@@ -0,0 +1,417 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// walOp identifies the kind of mutation a WAL record describes.
+type walOp byte
+
+const (
+	walOpPut walOp = iota + 1
+	walOpDelete
+)
+
+// SyncPolicy controls when the WAL fsyncs to disk. The tighter the policy,
+// the smaller the window of writes that can be lost to a crash, at the cost
+// of throughput.
+type SyncPolicy struct {
+	// always, when true, fsyncs after every commit. interval is ignored
+	// when this is set.
+	always bool
+	// interval, when non-zero, fsyncs at most once per interval; writes in
+	// between are batched onto the next tick.
+	interval time.Duration
+}
+
+// SyncAlways fsyncs the WAL after every write or destroy. It is the safest
+// and slowest policy.
+func SyncAlways() SyncPolicy { return SyncPolicy{always: true} }
+
+// SyncInterval fsyncs the WAL at most once per d, batching writes that
+// happen within the same window onto a single fsync.
+func SyncInterval(d time.Duration) SyncPolicy { return SyncPolicy{interval: d} }
+
+// SyncNever leaves fsyncing to the operating system. Fastest, and the
+// backend relies entirely on a clean Checkpoint/Close for durability.
+func SyncNever() SyncPolicy { return SyncPolicy{} }
+
+// wal is an append-only write-ahead log: every mutation is appended as a
+// length-prefixed, CRC-checked record before it's considered durable. On
+// restart, walReplay replays it on top of the last snapshot so that no
+// acknowledged write is lost between snapshots.
+type wal struct {
+	mu       sync.Mutex
+	file     *os.File
+	writer   *bufio.Writer
+	policy   SyncPolicy
+	pending  int // commits appended since the last fsync, for SyncInterval
+	stopTick chan struct{}
+
+	// writeSeq counts every record appended to writer, and commitSeq/
+	// commitErr/committing track the commit queue that group-commits
+	// SyncAlways writers; see groupCommit.
+	writeSeq   uint64
+	commitMu   sync.Mutex
+	commitCond *sync.Cond
+	committing bool
+	commitSeq  uint64
+	commitErr  error
+}
+
+func openWAL(location string, policy SyncPolicy) (*wal, error) {
+	file, err := os.OpenFile(location, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	w := &wal{
+		file:   file,
+		writer: bufio.NewWriter(file),
+		policy: policy,
+	}
+	w.commitCond = sync.NewCond(&w.commitMu)
+	if policy.interval > 0 {
+		w.stopTick = make(chan struct{})
+		go w.tick()
+	}
+	return w, nil
+}
+
+func (w *wal) tick() {
+	ticker := time.NewTicker(w.policy.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.pending > 0 {
+				w.fsyncLocked()
+			}
+			w.mu.Unlock()
+		case <-w.stopTick:
+			return
+		}
+	}
+}
+
+// appendPut writes a Put record for key/record to the log, honouring the
+// configured SyncPolicy. Concurrent callers are group-committed: each holds
+// the WAL mutex only long enough to append its own record, and a single
+// caller per batch pays for the fsync.
+func (w *wal) appendPut(key string, r *NabiaRecord) error {
+	return w.append(walOpPut, key, r)
+}
+
+func (w *wal) appendDelete(key string) error {
+	return w.append(walOpDelete, key, nil)
+}
+
+// encodeWALRecord frames a WAL record: op, key, then every NabiaRecord field
+// a Put needs to round-trip exactly (ContentType, RawData, and the
+// Kind/BlobRef/BlobSize that mark a blob stub; see stream.go) so a stub
+// replayed from the WAL is indistinguishable from one read straight out of
+// the snapshot. r is nil for a Delete, which still writes the zero value of
+// each field to keep the framing uniform.
+func encodeWALRecord(op walOp, key string, r *NabiaRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(byte(op))
+	writeUvarintString(&buf, key)
+	if r == nil {
+		r = &NabiaRecord{}
+	}
+	writeUvarintString(&buf, r.ContentType)
+	writeUvarintBytes(&buf, r.RawData)
+	writeUvarintString(&buf, r.Kind)
+	writeUvarintString(&buf, r.BlobRef)
+	writeUvarintUint64(&buf, uint64(r.BlobSize))
+
+	sum := crc32.ChecksumIEEE(buf.Bytes())
+	if err := binary.Write(&buf, binary.BigEndian, sum); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (w *wal) append(op walOp, key string, r *NabiaRecord) error {
+	encoded, err := encodeWALRecord(op, key, r)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	if _, err := w.writer.Write(encoded); err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	w.pending++
+	w.writeSeq++
+	mySeq := w.writeSeq
+
+	switch {
+	case w.policy.always:
+		w.mu.Unlock()
+		return w.groupCommit(mySeq)
+	case w.policy.interval > 0:
+		w.mu.Unlock()
+		return nil // the ticker goroutine will fsync this batch
+	default:
+		defer w.mu.Unlock()
+		return w.writer.Flush()
+	}
+}
+
+// groupCommit ensures an fsync covering mySeq has completed, merging
+// concurrent SyncAlways writers onto a single fsync instead of each paying
+// for its own: the first caller to arrive becomes the leader and flushes on
+// behalf of every append that landed before it started (including any that
+// slip in while it's acquiring the lock), and everyone else just waits for
+// that fsync's result.
+func (w *wal) groupCommit(mySeq uint64) error {
+	w.commitMu.Lock()
+	for w.commitSeq < mySeq && w.committing {
+		w.commitCond.Wait()
+	}
+	if w.commitSeq >= mySeq {
+		err := w.commitErr
+		w.commitMu.Unlock()
+		return err
+	}
+	w.committing = true
+	w.commitMu.Unlock()
+
+	w.mu.Lock()
+	err := w.fsyncLocked()
+	committed := w.writeSeq
+	w.mu.Unlock()
+
+	w.commitMu.Lock()
+	w.commitErr = err
+	w.commitSeq = committed
+	w.committing = false
+	w.commitCond.Broadcast()
+	w.commitMu.Unlock()
+	return err
+}
+
+// appendBatch writes every put/delete in the set as individual records
+// under a single lock hold, followed by exactly one fsync: the group-commit
+// Tx.Commit uses to avoid paying for an fsync per key. The records carry no
+// batch marker, so if a crash cuts the batch short, walReplay applies
+// whichever of its records reached disk intact.
+func (w *wal) appendBatch(puts map[string]*NabiaRecord, deletes map[string]struct{}) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for key, r := range puts {
+		encoded, err := encodeWALRecord(walOpPut, key, r)
+		if err != nil {
+			return err
+		}
+		if _, err := w.writer.Write(encoded); err != nil {
+			return err
+		}
+	}
+	for key := range deletes {
+		encoded, err := encodeWALRecord(walOpDelete, key, nil)
+		if err != nil {
+			return err
+		}
+		if _, err := w.writer.Write(encoded); err != nil {
+			return err
+		}
+	}
+	w.pending++
+	return w.fsyncLocked()
+}
+
+func (w *wal) fsyncLocked() error {
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.pending = 0
+	return nil
+}
+
+// truncate discards all WAL contents, used right after a successful
+// Checkpoint has made them redundant.
+func (w *wal) truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.writer.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.writer.Reset(w.file)
+	w.pending = 0
+	return nil
+}
+
+func (w *wal) close() error {
+	if w.stopTick != nil {
+		close(w.stopTick)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.fsyncLocked(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// setPolicy swaps the active SyncPolicy, restarting the background ticker
+// if the new policy is interval-based.
+func (w *wal) setPolicy(policy SyncPolicy) {
+	w.mu.Lock()
+	if w.stopTick != nil {
+		close(w.stopTick)
+		w.stopTick = nil
+	}
+	w.policy = policy
+	w.mu.Unlock()
+	if policy.interval > 0 {
+		w.stopTick = make(chan struct{})
+		go w.tick()
+	}
+}
+
+// walReplay reads every well-formed record from location and applies put to
+// each Put and del to each Delete, in log order. It stops, without error, as
+// soon as it hits a record whose CRC doesn't check out: that's the tail of
+// a torn write from a crash mid-append, and everything before it is still
+// valid.
+func walReplay(location string, put func(key string, r *NabiaRecord), del func(key string)) error {
+	file, err := os.Open(location)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		opByte, err := reader.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return nil // truncated op byte: torn write, stop here
+		}
+
+		var rec bytes.Buffer
+		rec.WriteByte(opByte)
+
+		key, ok := readUvarintString(reader, &rec)
+		if !ok {
+			return nil
+		}
+		ct, ok := readUvarintString(reader, &rec)
+		if !ok {
+			return nil
+		}
+		data, ok := readUvarintBytes(reader, &rec)
+		if !ok {
+			return nil
+		}
+		kind, ok := readUvarintString(reader, &rec)
+		if !ok {
+			return nil
+		}
+		blobRef, ok := readUvarintString(reader, &rec)
+		if !ok {
+			return nil
+		}
+		blobSize, ok := readUvarintUint64(reader, &rec)
+		if !ok {
+			return nil
+		}
+
+		var wantSum uint32
+		if err := binary.Read(reader, binary.BigEndian, &wantSum); err != nil {
+			return nil
+		}
+		gotSum := crc32.ChecksumIEEE(rec.Bytes())
+		if gotSum != wantSum {
+			return nil // torn/corrupt trailing record, stop replaying
+		}
+
+		switch walOp(opByte) {
+		case walOpPut:
+			put(key, &NabiaRecord{RawData: data, ContentType: ct, Kind: kind, BlobRef: blobRef, BlobSize: int64(blobSize)})
+		case walOpDelete:
+			del(key)
+		default:
+			return nil // unknown op: treat the rest as unreadable
+		}
+	}
+}
+
+func writeUvarintBytes(buf *bytes.Buffer, b []byte) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	buf.Write(lenBuf[:n])
+	buf.Write(b)
+}
+
+func writeUvarintString(buf *bytes.Buffer, s string) {
+	writeUvarintBytes(buf, []byte(s))
+}
+
+func writeUvarintUint64(buf *bytes.Buffer, v uint64) {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], v)
+	buf.Write(lenBuf[:n])
+}
+
+func readUvarintBytes(r *bufio.Reader, rec *bytes.Buffer) ([]byte, bool) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, false
+	}
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], length)
+	rec.Write(lenBuf[:n])
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, false
+	}
+	rec.Write(b)
+	return b, true
+}
+
+func readUvarintString(r *bufio.Reader, rec *bytes.Buffer) (string, bool) {
+	b, ok := readUvarintBytes(r, rec)
+	if !ok {
+		return "", false
+	}
+	return string(b), true
+}
+
+func readUvarintUint64(r *bufio.Reader, rec *bytes.Buffer) (uint64, bool) {
+	v, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, false
+	}
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], v)
+	rec.Write(lenBuf[:n])
+	return v, true
+}